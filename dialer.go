@@ -3,16 +3,22 @@
 // or more generally making requests to URLs that you don't necessarily trust
 // completely.
 //
-// Usually you will use the Dial function in an HTTP Client as follows:
+// Usually you will use the DialContext function in an HTTP Client as follows:
 //
 //     client := http.Client{
 //         Transport: &http.Transport{
 //              Proxy: http.ProxyFromEnvironment,
-//				Dial: proxydialer.Dial,
+//				DialContext: proxydial.DialContext,
 //              TLSHandshakeTimeout: 10 * time.Second
 //         }
 //     }
 //
+// Transport.DialContext is preferred over the older Transport.Dial hook because
+// it's given the request's context, so dials are cancelled as soon as the request
+// is cancelled or its deadline passes (including deadlines set via http.Server's
+// BaseContext plumbing when this package is used to make outbound requests on
+// behalf of an incoming one).
+//
 // The advantage of the proxydialer is that it prevents connections being made to
 // internal IP addresses (e.g. 127.0.0.1, or 169.254.169.254) or to ports that could
 // cause harm to the rest of the internet (e.g. 22, 25).
@@ -20,16 +26,39 @@
 package proxydial
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"strconv"
+	"sync"
+	"syscall"
 	"time"
 )
 
+// defaultFallbackDelay is the RFC 8305 section 3 recommended delay before starting a
+// connection attempt to the next address family, used when Dialer.FallbackDelay is zero.
+const defaultFallbackDelay = 300 * time.Millisecond
+
+// staggerDelay is how long dialParallel waits before starting an attempt to the next
+// address within the same family, so a single slow address doesn't hold up every other
+// address in its group.
+const staggerDelay = 250 * time.Millisecond
+
+// testHookDialContext is overridden in tests to inject artificial delay into individual
+// racing attempts without depending on real network timing.
+var testHookDialContext = func(d *net.Dialer, ctx context.Context, network, addr string) (net.Conn, error) {
+	return d.DialContext(ctx, network, addr)
+}
+
+// defaultOwnIPCacheInterval is how long the set of local interface addresses used by
+// BlockOwnIP is cached for, used when Dialer.OwnIPCacheInterval is zero.
+const defaultOwnIPCacheInterval = time.Minute
+
 // Dialer lets you connect to external addresses. It's equivalent to net.Dialer
 // from the go standard library, except that connections that are not to AllowedNets,
-// not to AllowedPorts, or to BlockedRanges are aborted. It also does not yet support
-// HappyEyeballs.
+// not to AllowedPorts, or to BlockedRanges are aborted. It also implements Happy
+// Eyeballs (RFC 8305): it races a connection attempt to each resolved address,
+// preferring IPv6, and returns whichever succeeds first.
 type Dialer struct {
 	// AllowedNets is a whitelist of nets that connections may be made over. For http
 	// this should be only []string{"tcp"}
@@ -85,8 +114,160 @@ type Dialer struct {
 	// network being dialed.
 	// If nil, a local address is automatically chosen.
 	LocalAddr net.Addr
+
+	// Resolver is used to resolve hostnames to IP addresses. If nil, net.DefaultResolver
+	// is used. Inject a DNS-over-HTTPS resolver, a caching resolver, or a test stub here;
+	// *net.Resolver already satisfies this interface.
+	Resolver Resolver
+
+	// ResolveOnce, when true, dials only the first IP address returned by Resolver instead
+	// of falling back across every address it returned. This pins the dial to the exact
+	// address that was validated, and the returned net.Conn is a *Conn so callers that need
+	// it (for example to set a TLS ServerName) can recover the original hostname. When
+	// false, dialParallel races every resolved address. Either way, every resolved address
+	// is checked by blockReason before any dial, and the Control hook re-checks the address
+	// each attempt is about to connect to.
+	ResolveOnce bool
+
+	// FallbackDelay is how long dialParallel waits, after starting a connection attempt
+	// to the preferred address family (IPv6), before it also starts an attempt to the
+	// other family. If zero, a default of 300ms is used, per RFC 8305 section 3.
+	FallbackDelay time.Duration
+
+	// BlockOwnIP blocks any IP address that belongs to one of this host's own network
+	// interfaces. Without this, a request to the host's own public IP can be routed back
+	// via loopback on Linux, bypassing firewalls that only filter externally-arriving
+	// traffic.
+	BlockOwnIP bool
+
+	// OwnIPCacheInterval controls how often the set of local interface addresses used by
+	// BlockOwnIP is refreshed. If zero, a default of 1 minute is used. The addresses are
+	// cached because enumerating interfaces on every dial would be wasteful.
+	OwnIPCacheInterval time.Duration
+
+	ownIPMu          sync.Mutex
+	ownIPCache       map[string]bool
+	ownIPCacheExpiry time.Time
+}
+
+// Resolver is the interface used by Dialer to resolve hostnames to IP addresses. It's
+// satisfied by *net.Resolver, so net.DefaultResolver (the zero-value default) as well as
+// custom resolvers can be used interchangeably.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+func (d *Dialer) resolver() Resolver {
+	if d.Resolver != nil {
+		return d.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// Conn is returned by Dialer.Dial and Dialer.DialContext when ResolveOnce is set. It wraps
+// the underlying net.Conn with the hostname and IP address that were resolved and dialed,
+// since the connection itself was made to a literal IP.
+type Conn struct {
+	net.Conn
+
+	// Host is the hostname that was resolved.
+	Host string
+	// IP is the address that Host resolved to, and that was dialed.
+	IP net.IP
+}
+
+// BlockReason identifies why a dial was refused by a Dialer's policy.
+type BlockReason int
+
+// The reasons a Dialer can refuse a dial. Zero is not a valid reason; it's used by
+// blockReason to mean "not blocked".
+const (
+	BlockReasonNet BlockReason = iota + 1
+	BlockReasonPort
+	BlockReasonIP
+	BlockReasonRange
+	BlockReasonPrivate
+	BlockReasonLoopback
+	BlockReasonLinkLocal
+	BlockReasonMulticast
+	BlockReasonOwnIP
+)
+
+func (r BlockReason) String() string {
+	switch r {
+	case BlockReasonNet:
+		return "invalid net"
+	case BlockReasonPort:
+		return "blocked port"
+	case BlockReasonIP:
+		return "blocked ip"
+	case BlockReasonRange:
+		return "blocked range"
+	case BlockReasonPrivate:
+		return "private ip"
+	case BlockReasonLoopback:
+		return "loopback ip"
+	case BlockReasonLinkLocal:
+		return "link-local ip"
+	case BlockReasonMulticast:
+		return "multicast ip"
+	case BlockReasonOwnIP:
+		return "own ip"
+	default:
+		return "blocked"
+	}
+}
+
+// BlockError is returned by Dial and DialContext (and by the Control hook, wrapped by the
+// net package) when a dial is refused by the Dialer's policy, rather than failing at the
+// network layer. Reason lets callers count or alert on SSRF attempts without parsing
+// Error()'s text; use errors.Is against the Err* sentinels below, or errors.As to recover
+// the IP/Port that triggered the block.
+type BlockError struct {
+	Reason  BlockReason
+	Network string
+	Addr    string
+	IP      net.IP
+	Port    int
+}
+
+func (e *BlockError) Error() string {
+	switch e.Reason {
+	case BlockReasonNet:
+		return fmt.Sprintf("dialer.Dial %s %s: invalid net", e.Network, e.Addr)
+	case BlockReasonPort:
+		return fmt.Sprintf("dialer.Dial %s: blocked port", e.Addr)
+	default:
+		if e.IP != nil {
+			return fmt.Sprintf("dialer.Dial %s: blocked range (%s)", e.Addr, e.IP)
+		}
+		return fmt.Sprintf("dialer.Dial %s: blocked", e.Addr)
+	}
+}
+
+// Is lets errors.Is match a BlockError against one of the Err* sentinels below by Reason,
+// ignoring the instance-specific Network/Addr/IP/Port fields.
+func (e *BlockError) Is(target error) bool {
+	sentinel, ok := target.(*BlockError)
+	if !ok {
+		return false
+	}
+	return sentinel.Reason != 0 && sentinel.Reason == e.Reason
 }
 
+// Sentinel BlockErrors, one per BlockReason, for use with errors.Is.
+var (
+	ErrBlockedNet       = &BlockError{Reason: BlockReasonNet}
+	ErrBlockedPort      = &BlockError{Reason: BlockReasonPort}
+	ErrBlockedIP        = &BlockError{Reason: BlockReasonIP}
+	ErrBlockedRange     = &BlockError{Reason: BlockReasonRange}
+	ErrBlockedPrivate   = &BlockError{Reason: BlockReasonPrivate}
+	ErrBlockedLoopback  = &BlockError{Reason: BlockReasonLoopback}
+	ErrBlockedLinkLocal = &BlockError{Reason: BlockReasonLinkLocal}
+	ErrBlockedMulticast = &BlockError{Reason: BlockReasonMulticast}
+	ErrBlockedOwnIP     = &BlockError{Reason: BlockReasonOwnIP}
+)
+
 func cidrRange(str string) *net.IPNet {
 
 	_, net, err := net.ParseCIDR(str)
@@ -146,6 +327,11 @@ func Dial(network, addr string) (net.Conn, error) {
 	return DefaultDialer.Dial(network, addr)
 }
 
+// DialContext creates a connection to the given address using DefaultDialer.DialContext
+func DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return DefaultDialer.DialContext(ctx, network, addr)
+}
+
 func (d *Dialer) allowedNet(network string) bool {
 	for _, net := range d.AllowedNets {
 		if net == network {
@@ -165,38 +351,184 @@ func (d *Dialer) allowedPort(port int16) bool {
 	return false
 }
 
-func (d *Dialer) allowedIP(ip net.IP) bool {
-	if d.BlockPrivate && (ip.IsPrivate() || ip.IsLoopback()) {
-		return false
+// blockReason reports why ip is refused by d's policy, or zero if it's allowed.
+func (d *Dialer) blockReason(ip net.IP) BlockReason {
+	if d.BlockPrivate && ip.IsLoopback() {
+		return BlockReasonLoopback
+	}
+
+	if d.BlockPrivate && ip.IsPrivate() {
+		return BlockReasonPrivate
 	}
 
 	if d.BlockLinkLocal && (ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast()) {
-		return false
+		return BlockReasonLinkLocal
 	}
 
 	if d.BlockMulticast && (ip.IsMulticast() || ip.IsInterfaceLocalMulticast()) {
-		return false
+		return BlockReasonMulticast
 	}
 
 	if d.BlockUnspecified && ip.IsUnspecified() {
-		return false
+		return BlockReasonIP
+	}
+
+	if d.BlockOwnIP {
+		isOwn, err := d.IsOwnIP(ip)
+		if err != nil || isOwn {
+			// Fail closed: if we can't enumerate our own interfaces, don't risk
+			// letting a request through that might be targeting one of them.
+			return BlockReasonOwnIP
+		}
 	}
 
 	for _, netrange := range d.BlockedRanges {
 		if netrange.Contains(ip) {
-			return false
+			return BlockReasonRange
+		}
+	}
+
+	return 0
+}
+
+// IsBlockedIP reports whether a dial to ip through d would be refused. It's the exported,
+// boolean-returning counterpart of the validation Dial and DialContext perform internally.
+func (d *Dialer) IsBlockedIP(ip net.IP) bool {
+	return d.blockReason(ip) != 0
+}
+
+// IsReservedIP reports whether ip falls within a reserved or otherwise internal range,
+// using DefaultDialer's BlockedRanges and Block* flags. It's a convenience for code that
+// wants to reuse proxydial's notion of "reserved" without constructing its own Dialer.
+func IsReservedIP(ip net.IP) bool {
+	return DefaultDialer.IsBlockedIP(ip)
+}
+
+// ownIPs returns the set of IP addresses (as their String() form) assigned to this host's
+// network interfaces, refreshing the cached snapshot if it's older than
+// OwnIPCacheInterval.
+func (d *Dialer) ownIPs() (map[string]bool, error) {
+	d.ownIPMu.Lock()
+	defer d.ownIPMu.Unlock()
+
+	if d.ownIPCache != nil && time.Now().Before(d.ownIPCacheExpiry) {
+		return d.ownIPCache, nil
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make(map[string]bool)
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			var ip net.IP
+			switch a := addr.(type) {
+			case *net.IPNet:
+				ip = a.IP
+			case *net.IPAddr:
+				ip = a.IP
+			}
+			if ip != nil {
+				ips[ip.String()] = true
+			}
 		}
 	}
-	return true
+
+	interval := d.OwnIPCacheInterval
+	if interval <= 0 {
+		interval = defaultOwnIPCacheInterval
+	}
+
+	d.ownIPCache = ips
+	d.ownIPCacheExpiry = time.Now().Add(interval)
+	return ips, nil
+}
+
+// IsOwnIP reports whether ip matches one of this host's own network interface addresses.
+// The set of local addresses is cached; see OwnIPCacheInterval.
+func (d *Dialer) IsOwnIP(ip net.IP) (bool, error) {
+	ips, err := d.ownIPs()
+	if err != nil {
+		return false, err
+	}
+	return ips[ip.String()], nil
+}
+
+// control is installed as the net.Dialer's Control hook. It's called after the socket
+// is created but before connect(2) is issued, with the exact numeric address the kernel
+// is about to connect to. dialParallel always dials a literal, already-validated IP
+// rather than a hostname, so this isn't closing a re-resolution race against
+// those callers; it's defense-in-depth re-validation of the address actually about to be
+// connected to, in case some future caller ever reaches here with an address that wasn't
+// already checked.
+func (d *Dialer) control(network, address string, c syscall.RawConn) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("dialer.Dial %s: control: not an IP address: %s", address, host)
+	}
+
+	portnum, err := parsePort(network, port)
+	if err != nil {
+		return err
+	}
+
+	if !d.allowedPort(int16(portnum)) {
+		return &BlockError{Reason: BlockReasonPort, Network: network, Addr: address, Port: portnum}
+	}
+
+	if reason := d.blockReason(ip); reason != 0 {
+		return &BlockError{Reason: reason, Network: network, Addr: address, IP: ip, Port: portnum}
+	}
+
+	return nil
+}
+
+// dialResult is sent on dialParallel's results channel by each racing attempt.
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// splitByFamily splits ips into the IPv6 and IPv4 addresses within it, preserving the
+// relative order of each group.
+func splitByFamily(ips []net.IP) (ipv6, ipv4 []net.IP) {
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			ipv4 = append(ipv4, ip)
+		} else {
+			ipv6 = append(ipv6, ip)
+		}
+	}
+	return ipv6, ipv4
 }
 
-func (d *Dialer) dialSerial(network, addr string, ips []net.IP, port string) (net.Conn, error) {
+// dialParallel implements Happy Eyeballs (RFC 8305): it races a connection attempt to
+// every address in ips, preferring IPv6 by starting those attempts first, and returns
+// whichever succeeds first. All other in-flight attempts are cancelled and their sockets
+// closed. If every attempt fails, the first error encountered is returned.
+func (d *Dialer) dialParallel(ctx context.Context, network, addr string, ips []net.IP, port string) (net.Conn, error) {
+
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("dialer.Dial no IP addresses found: %s", addr)
+	}
 
 	dialer := net.Dialer{
 		Timeout:   d.Timeout,
 		Deadline:  d.Deadline,
 		KeepAlive: d.KeepAlive,
 		LocalAddr: d.LocalAddr,
+		Control:   d.control,
 	}
 
 	// Ensure the deadline is set when a timeout is set, so that the total
@@ -210,8 +542,8 @@ func (d *Dialer) dialSerial(network, addr string, ips []net.IP, port string) (ne
 	}
 
 	// Ensure that the timeout for each operation is small enough that
-	// if connecting to the first address times out, the other addresses
-	// will be tried.
+	// if connecting to one address times out, the others being raced
+	// still get a chance to complete within the overall deadline.
 	if !dialer.Deadline.IsZero() {
 		totalTime := dialer.Deadline.Sub(time.Now())
 		newTimeout := totalTime / time.Duration(len(ips))
@@ -226,18 +558,103 @@ func (d *Dialer) dialSerial(network, addr string, ips []net.IP, port string) (ne
 
 	}
 
+	fallbackDelay := d.FallbackDelay
+	if fallbackDelay <= 0 {
+		fallbackDelay = defaultFallbackDelay
+	}
+
+	primary, secondary := splitByFamily(ips)
+	secondaryDelay := fallbackDelay
+	if len(primary) == 0 {
+		// Nothing to prefer over, so don't make the only family wait for no reason.
+		secondaryDelay = 0
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Read once, up front: testHookDialContext is only ever swapped by a test before
+	// dialParallel is called, never while it's racing, and capturing it here means every
+	// racing goroutine below uses a local copy instead of re-reading the package variable.
+	dialContext := testHookDialContext
+
+	results := make(chan dialResult)
+	var wg sync.WaitGroup
+
+	race := func(group []net.IP, startDelay time.Duration) {
+		if len(group) == 0 {
+			return
+		}
+
+		timer := time.NewTimer(startDelay)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		for i, ip := range group {
+			if i > 0 {
+				stagger := time.NewTimer(staggerDelay)
+				select {
+				case <-ctx.Done():
+					stagger.Stop()
+					return
+				case <-stagger.C:
+				}
+			}
+
+			wg.Add(1)
+			go func(ip net.IP) {
+				defer wg.Done()
+				conn, err := dialContext(&dialer, ctx, network, net.JoinHostPort(ip.String(), port))
+				select {
+				case results <- dialResult{conn, err}:
+				case <-ctx.Done():
+					if conn != nil {
+						conn.Close()
+					}
+				}
+			}(ip)
+		}
+	}
+
+	wg.Add(2)
+	go func() { defer wg.Done(); race(primary, 0) }()
+	go func() { defer wg.Done(); race(secondary, secondaryDelay) }()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
 	var firstErr error
-	for _, ip := range ips {
-		conn, err := dialer.Dial(network, net.JoinHostPort(ip.String(), port))
-		if err != nil {
+	for res := range results {
+		if res.err != nil {
 			if firstErr == nil {
-				firstErr = err
+				firstErr = res.err
 			}
 			continue
 		}
-		return conn, nil
+
+		// We have a winner: stop every other in-flight attempt and close any
+		// connections that land after this one.
+		cancel()
+		go func() {
+			for res := range results {
+				if res.conn != nil {
+					res.conn.Close()
+				}
+			}
+		}()
+		return res.conn, nil
 	}
 
+	if firstErr == nil {
+		// No attempt reported back, which only happens when ctx ended before any started.
+		firstErr = ctx.Err()
+	}
 	if firstErr == nil {
 		firstErr = fmt.Errorf("dialer.Dial no IP addresses found: %s", addr)
 	}
@@ -249,9 +666,17 @@ func (d *Dialer) dialSerial(network, addr string, ips []net.IP, port string) (ne
 // or the port is not in d.AllowedPorts, or the IP address after DNS resolution is in b.BlockedRanges,
 // then the connection will not be attempted.
 func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext creates a connection to the given address, same as Dial, but it's given a
+// context that governs the whole dial, including DNS resolution. Cancelling the context,
+// or its deadline passing, aborts the dial: the error is ctx.Err() if no connection attempt
+// had started yet, and otherwise the resolver's or the connect attempt's own error.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
 
 	if !d.allowedNet(network) {
-		return nil, fmt.Errorf("dialer.Dial %s %s: invalid net", network, addr)
+		return nil, &BlockError{Reason: BlockReasonNet, Network: network, Addr: addr}
 	}
 
 	host, port, err := net.SplitHostPort(addr)
@@ -265,24 +690,37 @@ func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
 	}
 
 	if !d.allowedPort(int16(portnum)) {
-		return nil, fmt.Errorf("dialer.Dial %s: blocked port", addr)
+		return nil, &BlockError{Reason: BlockReasonPort, Network: network, Addr: addr, Port: portnum}
 	}
 
-	ips, err := net.LookupIP(host)
+	addrs, err := d.resolver().LookupIPAddr(ctx, host)
 
 	if err != nil {
 		return nil, err
 	}
 
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+
 	// Block any attempt to connect to any host that advertises an internal IP address.
 	// TODO:CI — in the real world are there systems that advertise both their internal &
 	// external IPs?
 	for _, ip := range ips {
-		if !d.allowedIP(ip) {
-			return nil, fmt.Errorf("dialer.Dial %s: blocked range (%s)", addr, ip)
+		if reason := d.blockReason(ip); reason != 0 {
+			return nil, &BlockError{Reason: reason, Network: network, Addr: addr, IP: ip, Port: portnum}
+		}
+	}
+
+	if d.ResolveOnce && len(ips) > 0 {
+		conn, err := d.dialParallel(ctx, network, addr, ips[:1], strconv.Itoa(portnum))
+		if err != nil {
+			return nil, err
 		}
+		return &Conn{Conn: conn, Host: host, IP: ips[0]}, nil
 	}
 
-	return d.dialSerial(network, addr, ips, strconv.Itoa(portnum))
+	return d.dialParallel(ctx, network, addr, ips, strconv.Itoa(portnum))
 
 }
@@ -1,9 +1,13 @@
 package proxydial
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -40,28 +44,28 @@ func TestDialer(t *testing.T) {
 
 func TestBlockedPorts(t *testing.T) {
 	_, err := client.Get("https://httpbin.org:25/get")
-	if err == nil || err.Error() != `Get "https://httpbin.org:25/get": dialer.Dial httpbin.org:25: blocked port` {
+	if !errors.Is(err, ErrBlockedPort) {
 		t.Fatal(err)
 	}
 }
 
 func TestLocalHost(t *testing.T) {
 	_, err := client.Get("http://localhost/")
-	if err == nil || err.Error() != `Get "http://localhost/": dialer.Dial localhost:80: blocked range (::1)` {
+	if !errors.Is(err, ErrBlockedLoopback) {
 		t.Error(err)
 	}
 }
 
 func TestBlockedIPv4(t *testing.T) {
 	_, err := client.Get("http://10.1.1.2/")
-	if err == nil || err.Error() != `Get "http://10.1.1.2/": dialer.Dial 10.1.1.2:80: blocked range (10.1.1.2)` {
+	if !errors.Is(err, ErrBlockedPrivate) {
 		t.Error(err)
 	}
 }
 
 func TestBlockedIPv6(t *testing.T) {
 	_, err := client.Get("http://[fe80::1]/")
-	if err == nil || err.Error() != `Get "http://[fe80::1]/": dialer.Dial [fe80::1]:80: blocked range (fe80::1)` {
+	if !errors.Is(err, ErrBlockedLinkLocal) {
 		t.Error(err)
 	}
 }
@@ -74,15 +78,444 @@ func TestBlocks(t *testing.T) {
 		"2130706433",           // decimal
 		"000127.0.00000.00001", // leading zeros
 	} {
-		requiredPrefix := fmt.Sprintf(`Get "http://%s/": dialer.Dial %s:80: blocked`, ip, ip)
 		_, err := client.Get(fmt.Sprintf("http://%s/", ip))
 
-		if err == nil || !strings.HasPrefix(err.Error(), requiredPrefix) {
-			t.Error(err)
+		var blockErr *BlockError
+		if !errors.As(err, &blockErr) {
+			t.Errorf("%s: expected a *BlockError, got %v", ip, err)
 		}
 	}
 }
 
+func TestDialContextCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := DefaultDialer.DialContext(ctx, "tcp", "example.com:80")
+	if err == nil {
+		t.Fatal("expected an error from a cancelled context")
+	}
+}
+
+// TestControlRevalidatesAddress hands dialParallel a blocked loopback address directly,
+// bypassing the earlier blockReason check, to confirm the Control hook independently
+// refuses to connect(2) to it. dialParallel only ever dials a literal, pre-validated IP -
+// never a hostname - so this isn't closing a DNS-rebinding race; it's defense-in-depth
+// re-validation of whatever address a dial attempt is actually about to use.
+func TestControlRevalidatesAddress(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan struct{}, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Close()
+			accepted <- struct{}{}
+		}
+	}()
+
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	portnum, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Dialer{
+		AllowedNets:  []string{"tcp"},
+		AllowedPorts: []int16{int16(portnum)},
+		BlockPrivate: true,
+	}
+
+	_, err = d.dialParallel(context.Background(), "tcp", "victim.example:"+port, []net.IP{net.ParseIP("127.0.0.1")}, port)
+	if !errors.Is(err, ErrBlockedLoopback) {
+		t.Fatalf("expected the control hook to block the dial, got: %v", err)
+	}
+
+	select {
+	case <-accepted:
+		t.Fatal("connection was accepted despite being blocked")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// fakeResolver is a Resolver stub that returns a fixed, crafted set of addresses (or a
+// fixed error) regardless of the host asked for.
+type fakeResolver struct {
+	addrs []net.IPAddr
+	err   error
+}
+
+func (f fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return f.addrs, f.err
+}
+
+func ipAddr(ip string) net.IPAddr {
+	return net.IPAddr{IP: net.ParseIP(ip)}
+}
+
+func TestResolverBlocksIfAnyAddressIsBlocked(t *testing.T) {
+	d := &Dialer{
+		AllowedNets:  []string{"tcp"},
+		AllowedPorts: []int16{80},
+		BlockPrivate: true,
+		Resolver: fakeResolver{addrs: []net.IPAddr{
+			ipAddr("93.184.216.34"), // allowed
+			ipAddr("10.0.0.1"),      // blocked
+		}},
+	}
+
+	_, err := d.Dial("tcp", "example.com:80")
+	var blockErr *BlockError
+	if !errors.As(err, &blockErr) || !blockErr.IP.Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatal(err)
+	}
+}
+
+func TestResolverBlocksIPv4MappedIPv6Loopback(t *testing.T) {
+	d := &Dialer{
+		AllowedNets:  []string{"tcp"},
+		AllowedPorts: []int16{80},
+		BlockPrivate: true,
+		Resolver:     fakeResolver{addrs: []net.IPAddr{ipAddr("::ffff:127.0.0.1")}},
+	}
+
+	_, err := d.Dial("tcp", "example.com:80")
+	if !errors.Is(err, ErrBlockedLoopback) {
+		t.Fatal(err)
+	}
+}
+
+func TestResolverPropagatesError(t *testing.T) {
+	resolveErr := fmt.Errorf("lookup example.com: boom")
+	d := &Dialer{
+		AllowedNets:  []string{"tcp"},
+		AllowedPorts: []int16{80},
+		Resolver:     fakeResolver{err: resolveErr},
+	}
+
+	_, err := d.Dial("tcp", "example.com:80")
+	if err != resolveErr {
+		t.Fatal(err)
+	}
+}
+
+// TestResolverEmptyResultWithTimeout guards against a fakeResolver{} (no addrs, no error,
+// a perfectly legal Resolver implementation) crashing dialParallel's deadline math with a
+// divide-by-zero instead of returning an error, when a Timeout or Deadline is configured.
+func TestResolverEmptyResultWithTimeout(t *testing.T) {
+	d := &Dialer{
+		AllowedNets:  []string{"tcp"},
+		AllowedPorts: []int16{80},
+		Timeout:      5 * time.Second,
+		Resolver:     fakeResolver{},
+	}
+
+	_, err := d.Dial("tcp", "example.com:80")
+	if err == nil {
+		t.Fatal("expected an error for a resolver that returned no addresses")
+	}
+}
+
+func TestResolveOnceDoesNotFallBackAcrossAddresses(t *testing.T) {
+	// 127.0.0.2 is loopback too, so it's a second address we can bind on the same port
+	// as 127.0.0.1 without a listener there, simulating one reachable and one dead address.
+	good, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("can't bind 127.0.0.2, skipping: %v", err)
+	}
+	defer good.Close()
+	go func() {
+		for {
+			conn, err := good.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(good.Addr().String())
+	portnum, _ := strconv.Atoi(port)
+
+	resolver := fakeResolver{addrs: []net.IPAddr{ipAddr("127.0.0.1"), ipAddr("127.0.0.2")}}
+
+	fallback := &Dialer{
+		AllowedNets:  []string{"tcp"},
+		AllowedPorts: []int16{int16(portnum)},
+		Resolver:     resolver,
+	}
+	// Without ResolveOnce, the dead 127.0.0.1 attempt fails and dialParallel falls back to
+	// 127.0.0.2, which is listening.
+	conn, err := fallback.Dial("tcp", "example.com:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	once := &Dialer{
+		AllowedNets:  []string{"tcp"},
+		AllowedPorts: []int16{int16(portnum)},
+		Resolver:     resolver,
+		ResolveOnce:  true,
+	}
+	// With ResolveOnce, only the first address (the dead one) is tried, with no fallback.
+	conn, err = once.Dial("tcp", "example.com:"+port)
+	if err == nil {
+		conn.Close()
+		t.Fatal("expected the dial to fail with no fallback to the second address")
+	}
+}
+
+func TestResolveOnceReturnsWrappedConn(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	portnum, _ := strconv.Atoi(port)
+
+	d := &Dialer{
+		AllowedNets:  []string{"tcp"},
+		AllowedPorts: []int16{int16(portnum)},
+		Resolver:     fakeResolver{addrs: []net.IPAddr{ipAddr("127.0.0.1")}},
+		ResolveOnce:  true,
+	}
+
+	conn, err := d.Dial("tcp", "example.com:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	wrapped, ok := conn.(*Conn)
+	if !ok {
+		t.Fatalf("expected a *Conn, got %T", conn)
+	}
+	if wrapped.Host != "example.com" || wrapped.IP.String() != "127.0.0.1" {
+		t.Fatalf("unexpected Conn: %+v", wrapped)
+	}
+}
+
+// TestHappyEyeballsFallsBackWithinFamily races a dead address against a live one in the
+// same family, proving the staggered attempts still fall through to the one that works.
+func TestHappyEyeballsFallsBackWithinFamily(t *testing.T) {
+	good, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("can't bind 127.0.0.2, skipping: %v", err)
+	}
+	defer good.Close()
+	go func() {
+		for {
+			conn, err := good.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(good.Addr().String())
+	portnum, _ := strconv.Atoi(port)
+
+	d := &Dialer{
+		AllowedNets:  []string{"tcp"},
+		AllowedPorts: []int16{int16(portnum)},
+	}
+
+	conn, err := d.dialParallel(context.Background(), "tcp", "example.com:"+port, []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.2")}, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+// TestHappyEyeballsClosesLoser verifies that once one racing attempt wins, a straggler
+// that nonetheless goes on to establish a real connection has that connection closed
+// rather than leaked.
+//
+// A genuine timing race won't do here: on loopback, a real connect completes in well
+// under a millisecond, far faster than the staggerDelay gap before dialParallel even
+// starts the next address in a group, so in practice the second address is cancelled
+// before it ever dials - there would be nothing established left to close. Instead this
+// uses testHookDialContext to hold the first address's already-established connection
+// back past the second address's own (unhindered, real) success, so the first address
+// loses the race only after it has a live connection that dialParallel must close.
+func TestHappyEyeballsClosesLoser(t *testing.T) {
+	loser, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loser.Close()
+
+	_, port, _ := net.SplitHostPort(loser.Addr().String())
+
+	winner, err := net.Listen("tcp", "127.0.0.2:"+port)
+	if err != nil {
+		t.Skipf("can't bind matching 127.0.0.2 port, skipping: %v", err)
+	}
+	defer winner.Close()
+
+	portnum, _ := strconv.Atoi(port)
+
+	loserAccepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := loser.Accept()
+		if err == nil {
+			loserAccepted <- conn
+		}
+	}()
+	go func() {
+		for {
+			conn, err := winner.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	loserAddr := "127.0.0.1:" + port
+	origDial := testHookDialContext
+	defer func() { testHookDialContext = origDial }()
+	testHookDialContext = func(d *net.Dialer, ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := origDial(d, ctx, network, addr)
+		if err == nil && addr == loserAddr {
+			// Let the second address's stagger elapse and win the race before this
+			// one's already-successful connection is handed back.
+			time.Sleep(staggerDelay + 100*time.Millisecond)
+		}
+		return conn, err
+	}
+
+	d := &Dialer{
+		AllowedNets:  []string{"tcp"},
+		AllowedPorts: []int16{int16(portnum)},
+	}
+
+	conn, err := d.dialParallel(context.Background(), "tcp", "example.com:"+port, []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.2")}, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if got := conn.RemoteAddr().(*net.TCPAddr).IP.String(); got != "127.0.0.2" {
+		t.Fatalf("expected 127.0.0.2 to win after the held-back 127.0.0.1 attempt, got %s", got)
+	}
+
+	select {
+	case lc := <-loserAccepted:
+		lc.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := lc.Read(make([]byte, 1)); err == nil {
+			t.Fatal("expected the loser's connection to have been closed by the client")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the loser's attempt was never accepted by the server")
+	}
+}
+
+func TestIsReservedIP(t *testing.T) {
+	if !IsReservedIP(net.ParseIP("127.0.0.1")) {
+		t.Error("expected 127.0.0.1 to be reserved")
+	}
+	if !IsReservedIP(net.ParseIP("169.254.169.254")) {
+		t.Error("expected 169.254.169.254 to be reserved")
+	}
+	if IsReservedIP(net.ParseIP("93.184.216.34")) {
+		t.Error("expected 93.184.216.34 (example.com) not to be reserved")
+	}
+}
+
+func TestIsBlockedIP(t *testing.T) {
+	d := &Dialer{BlockPrivate: true}
+	if !d.IsBlockedIP(net.ParseIP("10.0.0.1")) {
+		t.Error("expected 10.0.0.1 to be blocked")
+	}
+	if d.IsBlockedIP(net.ParseIP("93.184.216.34")) {
+		t.Error("expected 93.184.216.34 (example.com) not to be blocked")
+	}
+}
+
+func TestBlockOwnIP(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ownIP net.IP
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
+				ownIP = ipnet.IP
+			}
+		}
+	}
+	if ownIP == nil {
+		t.Skip("host has no non-loopback interface address to test against")
+	}
+
+	d := &Dialer{BlockOwnIP: true}
+
+	isOwn, err := d.IsOwnIP(ownIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isOwn {
+		t.Fatalf("expected %s to be recognised as an own IP", ownIP)
+	}
+
+	if !d.IsBlockedIP(ownIP) {
+		t.Fatalf("expected %s to be blocked when BlockOwnIP is set", ownIP)
+	}
+
+	isOwn, err = d.IsOwnIP(net.ParseIP("93.184.216.34"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isOwn {
+		t.Fatal("expected example.com's IP not to be recognised as an own IP")
+	}
+}
+
+func TestBlockErrorIsMatchesByReasonOnly(t *testing.T) {
+	err := &BlockError{Reason: BlockReasonPrivate, Addr: "10.0.0.1:80", IP: net.ParseIP("10.0.0.1"), Port: 80}
+
+	if !errors.Is(err, ErrBlockedPrivate) {
+		t.Fatal("expected errors.Is to match on Reason alone")
+	}
+	if errors.Is(err, ErrBlockedLoopback) {
+		t.Fatal("expected errors.Is not to match a different Reason")
+	}
+
+	wrapped := fmt.Errorf("dialing: %w", err)
+	if !errors.Is(wrapped, ErrBlockedPrivate) {
+		t.Fatal("expected errors.Is to see through %w wrapping")
+	}
+
+	var blockErr *BlockError
+	if !errors.As(wrapped, &blockErr) || !blockErr.IP.Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatal("expected errors.As to recover the original *BlockError")
+	}
+}
+
 func TestResolutionFailure(t *testing.T) {
 	_, err := client.Get("https://fails.to.resolve.lllllllllllll")
 	if err == nil || err.Error() != "Get https://fails.to.resolve.lllllllllllll: lookup fails.to.resolve.lllllllllllll: no such host" {